@@ -0,0 +1,335 @@
+import http.server
+import os
+import tempfile
+import threading
+import unittest
+
+import dl
+
+# a small h5ai style tree, {path with query: listing html}. {root} is the
+# http://127.0.0.1:<port> of the test server. /pub/a/b/ is split into two
+# pages, its c/ is linked from the second one and, with // and /./ in the
+# href, from /pub/a/
+TREE = {
+    '/pub/': '''<html><body>
+        <a href="..">Parent Directory</a>
+        <a href="/pub/?C=N;O=D">Name</a>
+        <a href="?sort=size">Size</a>
+        <a href="/_h5ai/public/images/folder.svg">icon</a>
+        <a href="one.txt">one.txt</a>
+        <a href='quoted.txt'>quoted.txt</a>
+        <a href="{root}/pub/abs.txt">abs.txt</a>
+        <a href="http://other.invalid/pub/elsewhere.txt">elsewhere.txt</a>
+        <a href="/pub/a/">a</a>
+        </body></html>''',
+    '/pub/a/': '''<html><body>
+        <a href="../">Parent Directory</a>
+        <a href="two.txt">two.txt</a>
+        <a href="{root}/pub/./a//two.txt">two.txt again</a>
+        <a href='b/'>b</a>
+        <a href="b//./c/">c from here</a>
+        </body></html>''',
+    '/pub/a/b/': '''<html><body>
+        <a href="/pub/a/">Parent Directory</a>
+        <a href="three.txt">three.txt</a>
+        <a rel="next" href="?page=2">next</a>
+        </body></html>''',
+    '/pub/a/b/?page=2': '''<html><body>
+        <a href="/pub/a/">Parent Directory</a>
+        <a href="four.txt">four.txt</a>
+        <a href="c/">c</a>
+        </body></html>''',
+    '/pub/a/b/c/': '''<html><body>
+        <a href="..">Parent Directory</a>
+        <a href="five.txt">five.txt</a>
+        </body></html>''',
+}
+
+class Handler(http.server.BaseHTTPRequestHandler):
+    def do_GET(self):
+        page = TREE.get(self.path)
+        if page is None:
+            body = self.path.encode('utf-8')
+            content_type = 'application/octet-stream'
+        else:
+            body = page.format(root=self.server.root).encode('utf-8')
+            content_type = 'text/html'
+        self.send_response(200)
+        self.send_header('Content-Type', content_type)
+        self.send_header('Content-Length', str(len(body)))
+        self.end_headers()
+        self.wfile.write(body)
+
+    def log_message(self, *args):
+        pass
+
+class H5aiTestCase(unittest.TestCase):
+    @classmethod
+    def setUpClass(cls):
+        # port 0 picks a free one, never 80
+        cls.server = http.server.ThreadingHTTPServer(('127.0.0.1', 0), Handler)
+        cls.server.root = 'http://127.0.0.1:{}'.format(cls.server.server_port)
+        threading.Thread(target=cls.server.serve_forever, daemon=True).start()
+
+    @classmethod
+    def tearDownClass(cls):
+        cls.server.shutdown()
+        cls.server.server_close()
+
+    def setUp(self):
+        self.saved_options = vars(dl.options).copy()
+        dl.options.log_level = 'quiet'
+        dl.options.no_cache = True
+        # the status directories are written to the working directory
+        self.saved_cwd = os.getcwd()
+        self.directory = tempfile.TemporaryDirectory()
+        os.chdir(self.directory.name)
+        dl.failed_listings.clear()
+        dl.reset()
+
+    def tearDown(self):
+        os.chdir(self.saved_cwd)
+        self.directory.cleanup()
+        vars(dl.options).clear()
+        vars(dl.options).update(self.saved_options)
+
+    def url(self, path):
+        return self.server.root + path
+
+    def crawl(self, depth):
+        return sorted(dl.crawl(self.url('/pub/'), depth))
+
+class CrawlTest(H5aiTestCase):
+    def test_depth_zero_lists_only_the_given_directory(self):
+        self.assertEqual(self.crawl(0), [self.url('/pub/abs.txt'), self.url('/pub/one.txt'), self.url('/pub/quoted.txt')])
+
+    def test_depth_counts_folder_levels(self):
+        self.assertEqual(self.crawl(1), sorted([
+            self.url('/pub/abs.txt'), self.url('/pub/one.txt'), self.url('/pub/quoted.txt'),
+            self.url('/pub/a/two.txt')]))
+
+    def test_pages_of_a_listing_do_not_add_depth(self):
+        # four.txt is on the second page of pub/a/b/, c/ is linked from it
+        self.assertIn(self.url('/pub/a/b/four.txt'), self.crawl(2))
+        self.assertNotIn(self.url('/pub/a/b/c/five.txt'), self.crawl(2))
+        self.assertIn(self.url('/pub/a/b/c/five.txt'), self.crawl(3))
+
+    def test_whole_tree(self):
+        self.assertEqual(self.crawl(10), sorted(self.url(path) for path in (
+            '/pub/one.txt', '/pub/quoted.txt', '/pub/abs.txt', '/pub/a/two.txt',
+            '/pub/a/b/three.txt', '/pub/a/b/four.txt', '/pub/a/b/c/five.txt')))
+
+    def test_parent_query_and_control_links_are_not_followed(self):
+        files = self.crawl(10)
+        self.assertFalse([url for url in files if '?' in url or '_h5ai' in url or 'other.invalid' in url])
+        self.assertFalse(dl.failed_listings)
+
+    def test_no_crawl_state_is_left(self):
+        self.crawl(10)
+        self.assertFalse(os.path.exists('crawl_db'))
+        dl.options.dry_run = True
+        self.crawl(10)
+        self.assertFalse(os.path.exists('crawl_db'))
+
+    def test_negative_depth_is_an_error(self):
+        with self.assertRaises(ValueError):
+            dl.crawl(self.url('/pub/'), -1)
+
+class ResetTest(H5aiTestCase):
+    def tearDown(self):
+        dl.reset()
+        super().tearDown()
+
+    def test_crawl_runs_again_after_cancel(self):
+        dl.cancel()
+        self.assertTrue(dl.stopping())
+        dl.reset()
+        self.assertIn(self.url('/pub/a/b/c/five.txt'), self.crawl(10))
+
+    def test_crawl_timeout_starts_again(self):
+        dl.options.crawl_timeout = 60
+        dl.crawl_deadline.update({'at': 0, 'reached': True})
+        dl.reset()
+        self.assertIn(self.url('/pub/a/b/c/five.txt'), self.crawl(10))
+        self.assertFalse(dl.crawl_deadline['reached'])
+
+class OverlappingSourcesTest(H5aiTestCase):
+    def test_a_file_goes_to_the_first_source_that_found_it(self):
+        self.crawl(10)
+        self.assertEqual(dl.crawl(self.url('/pub/a/b/'), 10), [])
+        self.assertEqual(dl.cross_source_duplicates, {self.url('/pub/a/b/'): 3})
+
+    def test_reset_forgets_the_sources(self):
+        self.crawl(10)
+        dl.reset()
+        self.assertEqual(len(dl.crawl(self.url('/pub/a/b/'), 10)), 3)
+        self.assertFalse(dl.cross_source_duplicates)
+
+    def test_disjoint_sources_keep_their_files(self):
+        self.assertEqual(sorted(dl.crawl(self.url('/pub/a/b/c/'), 0)), [self.url('/pub/a/b/c/five.txt')])
+        self.assertNotIn(self.url('/pub/a/b/c/five.txt'), dl.crawl(self.url('/pub/'), 10))
+        self.assertIn(self.url('/pub/a/two.txt'), dl.crawl(self.url('/pub/'), 10))
+
+class PortTest(H5aiTestCase):
+    def test_port_is_kept_in_urls_and_left_out_of_status_names(self):
+        self.assertNotEqual(self.server.server_port, 80)
+        for url in self.crawl(10):
+            self.assertTrue(url.startswith(self.server.root + '/'))
+        self.assertNotIn(':', dl.url_to_file_name(self.url('/pub/')))
+        self.assertEqual(dl.get_target_domain(self.url('/pub/')), self.server.root)
+
+    def test_local_path_is_the_server_path(self):
+        domain = dl.get_target_domain(self.url('/pub/'))
+        self.assertEqual(dl.download_url_to_path(domain, self.url('/pub/a/two.txt')), os.path.join('.', 'pub/a/two.txt'))
+
+class CollisionTest(H5aiTestCase):
+    def setUp(self):
+        super().setUp()
+        dl.options.sort_by_ext = True
+        dl.local_paths.clear()
+        dl.path_owners.clear()
+        dl.path_maps.clear()
+
+    def assign(self, paths):
+        source = self.url('/pub/')
+        dl.local_paths.clear()
+        dl.path_owners.clear()
+        dl.path_maps.clear()
+        dl.assign_local_paths({source: [self.url(path) for path in paths]})
+        return {path: dl.local_paths[(source, self.url(path))] for path in paths}
+
+    def test_names_do_not_depend_on_crawl_order(self):
+        self.assertEqual(self.assign(['/pub/b/x.txt', '/pub/a/x.txt']), self.assign(['/pub/a/x.txt', '/pub/b/x.txt']))
+
+    def test_names_are_kept_when_another_url_joins(self):
+        first = self.assign(['/pub/c/x.txt', '/pub/b/x.txt'])
+        later = self.assign(['/pub/a/x.txt', '/pub/b/x.txt', '/pub/c/x.txt'])
+        self.assertEqual(later['/pub/b/x.txt'], first['/pub/b/x.txt'])
+        self.assertEqual(later['/pub/c/x.txt'], first['/pub/c/x.txt'])
+        self.assertEqual(later['/pub/a/x.txt'], os.path.join('.', 'txt', 'x (2).txt'))
+
+    def test_a_saved_name_is_kept_without_the_other_url(self):
+        first = self.assign(['/pub/a/x.txt', '/pub/b/x.txt'])
+        self.assertEqual(self.assign(['/pub/b/x.txt'])['/pub/b/x.txt'], first['/pub/b/x.txt'])
+
+class NormalizeUrlTest(unittest.TestCase):
+    def test_duplicate_slashes(self):
+        self.assertEqual(dl.normalize_url('http://host/pub//a///b.txt'), 'http://host/pub/a/b.txt')
+        self.assertEqual(dl.normalize_url('http://host//pub/'), 'http://host/pub/')
+
+    def test_dot_segments(self):
+        self.assertEqual(dl.normalize_url('http://host/pub/./a/b.txt'), 'http://host/pub/a/b.txt')
+        self.assertEqual(dl.normalize_url('http://host/pub/a/../b/'), 'http://host/pub/b/')
+        self.assertEqual(dl.normalize_url('http://host/pub/a/..'), 'http://host/pub/')
+        self.assertEqual(dl.normalize_url('http://host/../pub/'), 'http://host/pub/')
+
+    def test_trailing_slash_is_kept(self):
+        self.assertEqual(dl.normalize_url('http://host/pub/a//'), 'http://host/pub/a/')
+        self.assertEqual(dl.normalize_url('http://host/'), 'http://host/')
+        self.assertEqual(dl.normalize_url('http://host'), 'http://host')
+
+    def test_encoded_separators_stay_in_the_name(self):
+        self.assertEqual(dl.normalize_url('http://host/pub//a%2Fb.txt'), 'http://host/pub/a%2Fb.txt')
+        self.assertEqual(dl.normalize_url('http://host/pub/a%2F..%2Fb/'), 'http://host/pub/a%2F..%2Fb/')
+
+    def test_query_and_port_are_kept(self):
+        self.assertEqual(dl.normalize_url('http://host:8080/pub//a/?page=2'), 'http://host:8080/pub/a/?page=2')
+
+class UrlFileTest(unittest.TestCase):
+    def test_settings_and_comments(self):
+        lines = ['# failed: HTTP 404', 'http://host/a/ 2 flat', '', 'http://host/b/ depth=1 output=./b']
+        self.assertEqual(dl.parse_url_lines(lines, 'urls.txt', 4), [
+            ('http://host/a/', 2, {'flat': True}), ('http://host/b/', 1, {'output': './b'})])
+
+    def test_flat_applies_to_its_source_only(self):
+        dl.source_settings['http://host/a/'] = {'flat': True}
+        self.addCleanup(dl.source_settings.clear)
+        self.assertEqual(dl.local_path('http://host', 'http://host/a/', 'http://host/a/b/c.txt'), os.path.join('.', 'a_b_c.txt'))
+        self.assertEqual(dl.local_path('http://host', 'http://host/b/', 'http://host/b/c.txt'), os.path.join('.', 'b/c.txt'))
+
+class ConfigFileTest(H5aiTestCase):
+    def load(self, values):
+        import json
+        with open('config.json', 'w') as f:
+            json.dump(values, f)
+        parser = dl.argparse.ArgumentParser()
+        parser.add_argument('-d', '--depth', type=dl.parse_depth, action='append')
+        parser.add_argument('--retries', type=int)
+        dl.load_config_file('config.json', parser)
+
+    def test_numbers_are_checked_like_the_command_line(self):
+        self.load({'depth': 2, 'retries': 5})
+        self.assertEqual((dl.options.depth, dl.options.retries), ([2], 5))
+        for values in ({'depth': -1}, {'retries': 2.5}, {'retries': True}):
+            with self.assertRaises(SystemExit):
+                self.load(values)
+
+class CookieJarTest(H5aiTestCase):
+    def write(self, path, *names):
+        with open(path, 'w') as f:
+            f.write('# Netscape HTTP Cookie File\n')
+            f.writelines('host\tFALSE\t/\tFALSE\t0\t{}\tv\n'.format(name) for name in names)
+
+    def names(self):
+        return sorted(name for _, _, name in dl.read_cookies('cookies.txt'))
+
+    def test_requests_merge_only_their_changes(self):
+        dl.options.cookie_file = 'cookies.txt'
+        self.write('cookies.txt', 'old', 'gone')
+        first, second = dl.cookie_jar(), dl.cookie_jar()
+        # the first request drops a cookie, the second one still had it
+        self.write(first['path'], 'old', 'a')
+        self.write(second['path'], 'old', 'gone', 'b')
+        dl.save_cookie_jar(first)
+        dl.save_cookie_jar(second)
+        self.assertEqual(self.names(), ['a', 'b', 'old'])
+        self.assertFalse(os.path.exists(first['path']) or os.path.exists(second['path']))
+
+class HardlinkTest(H5aiTestCase):
+    def test_files_next_to_the_copy_are_kept(self):
+        for name, text in (('a.txt', 'same'), ('b.txt', 'same'), ('b.txt.link', 'mine')):
+            with open(name, 'w') as f:
+                f.write(text)
+        self.assertEqual(dl.hardlink_duplicates([(4, ['a.txt', 'b.txt'])]), 1)
+        self.assertTrue(os.path.samefile('a.txt', 'b.txt'))
+        with open('b.txt.link') as f:
+            self.assertEqual(f.read(), 'mine')
+        self.assertEqual(sorted(os.listdir('.')), ['a.txt', 'b.txt', 'b.txt.link'])
+
+class IndexLinkTest(unittest.TestCase):
+    def test_crawled_links_become_relative(self):
+        targets = {
+            'http://host/pub/a/b%20c.txt': os.path.join('.', 'pub', 'a', 'b c.txt'),
+            'http://host/pub/a/d/': os.path.join('.', 'pub', 'a', 'd', 'index.html'),
+            'http://host/pub/': os.path.join('.', 'pub', 'index.html'),
+        }
+        html = """<a href="b%20c.txt">b c</a><a href='d/'>d</a><a href=../>up</a>
+            <a href="?sort=size">size</a><a href="#top">top</a><a href="mailto:x@host">mail</a>"""
+        self.assertEqual(dl.rewrite_index_links(html, 'http://host/pub/a/', os.path.join('.', 'pub', 'a', 'index.html'), targets),
+            """<a href="b%20c.txt">b c</a><a href="d/index.html">d</a><a href="../index.html">up</a>
+            <a href="http://host/pub/a/?sort=size">size</a><a href="#top">top</a><a href="mailto:x@host">mail</a>""")
+
+class WindowsNameTest(unittest.TestCase):
+    def setUp(self):
+        self.saved_options = vars(dl.options).copy()
+
+    def tearDown(self):
+        vars(dl.options).clear()
+        vars(dl.options).update(self.saved_options)
+
+    def test_reserved_names_get_a_suffix(self):
+        self.assertEqual(dl.sanitize_path('pub/CON/nul.txt'), 'pub/CON_/nul_.txt')
+        self.assertEqual(dl.sanitize_path('pub/com1'), 'pub/com1_')
+        self.assertEqual(dl.sanitize_path('pub/console.txt'), 'pub/console.txt')
+        self.assertEqual(dl.sanitize_path('pub/lpt10'), 'pub/lpt10')
+
+    @unittest.skipIf(os.name == 'nt', 'names are always sanitized on Windows')
+    def test_names_are_kept_elsewhere(self):
+        self.assertEqual(dl.layout_path('pub/CON/nul.txt', '.'), os.path.join('.', 'pub/CON/nul.txt'))
+
+    @unittest.skipUnless(os.name == 'nt', 'only on Windows')
+    def test_names_are_sanitized_on_windows(self):
+        self.assertEqual(dl.layout_path('pub/CON/nul.txt', '.'), os.path.join('.', 'pub/CON_/nul_.txt'))
+
+if __name__ == '__main__':
+    unittest.main()